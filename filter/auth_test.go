@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestProxyFilter(t *testing.T, backend *httptest.Server, auth *AuthConfig) *Filter {
+	t.Helper()
+
+	f := &Filter{url: backend.URL, log: logrus.NewEntry(logrus.New()), auth: auth}
+	if auth != nil {
+		if err := auth.loadHtpasswd(); err != nil {
+			t.Fatalf("loadHtpasswd: %v", err)
+		}
+	}
+
+	return f
+}
+
+func newReverseProxy(f *Filter) *httputil.ReverseProxy {
+	target, _ := url.Parse(f.url)
+
+	return &httputil.ReverseProxy{
+		Director:  func(r *http.Request) { r.URL.Scheme, r.URL.Host = target.Scheme, target.Host },
+		Transport: f,
+	}
+}
+
+// TestRoundTripAuthDisabledPassesHeadersThrough is the regression test for
+// the chunk0-5 header-stripping bug: with f.auth nil, RoundTrip must not
+// touch a client-supplied Authorization header at all, since that stage
+// never even runs.
+func TestRoundTripAuthDisabledPassesHeadersThrough(t *testing.T) {
+	var gotAuth string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	f := newTestProxyFilter(t, backend, nil)
+	proxy := newReverseProxy(f)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer backend-owned-token")
+	rr := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status: got %d, want 200", rr.Code)
+	}
+
+	if want := "Bearer backend-owned-token"; gotAuth != want {
+		t.Fatalf("backend saw Authorization %q, want %q", gotAuth, want)
+	}
+}
+
+// TestRoundTripAuthEnabledStripsCredential checks the opposite side of the
+// same fix: once f.auth is configured, a validated Bearer credential IS
+// consumed here and must not leak to the backend.
+func TestRoundTripAuthEnabledStripsCredential(t *testing.T) {
+	var gotAuth string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	f := newTestProxyFilter(t, backend, &AuthConfig{BearerTokens: []string{"villip-token"}})
+	proxy := newReverseProxy(f)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer villip-token")
+	rr := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status: got %d, want 200", rr.Code)
+	}
+
+	if gotAuth != "" {
+		t.Fatalf("backend saw Authorization %q, want it stripped", gotAuth)
+	}
+}
+
+// TestRoundTripAuthEnabledRejectsMissingCredential checks the unauthorized
+// path still short-circuits with a challenge and never dials the backend.
+func TestRoundTripAuthEnabledRejectsMissingCredential(t *testing.T) {
+	backendHit := false
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHit = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	f := newTestProxyFilter(t, backend, &AuthConfig{BearerTokens: []string{"villip-token"}})
+	proxy := newReverseProxy(f)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rr := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status: got %d, want 401", rr.Code)
+	}
+
+	if backendHit {
+		t.Fatal("backend should never have been dialed for an unauthenticated request")
+	}
+}
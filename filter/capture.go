@@ -0,0 +1,148 @@
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture is a single recorded request/response pair. Fields are kept to
+// basic types so a Capture can be JSON-serialized as-is, both for the
+// dashboard API and for on-disk persistence.
+type Capture struct {
+	ID                 string      `json:"id"`
+	Proto              string      `json:"proto"`
+	Method             string      `json:"method"`
+	URL                string      `json:"url"`
+	Path               string      `json:"path"`
+	RequestHeader      http.Header `json:"request_header"`
+	RequestBody        []byte      `json:"request_body"`
+	ResponseHeader     http.Header `json:"response_header"`
+	ResponseBodyBefore []byte      `json:"response_body_before"`
+	ResponseBodyAfter  []byte      `json:"response_body_after"`
+	Status             int         `json:"status"`
+	ElapsedMS          int64       `json:"elapsed_ms"`
+	Timestamp          time.Time   `json:"timestamp"`
+}
+
+// DashboardItem is the trimmed summary returned by /api/captures, so listing
+// stays cheap even once captured bodies get large.
+type DashboardItem struct {
+	ID        string    `json:"id"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+	Timestamp time.Time `json:"timestamp"`
+	Rewritten bool      `json:"rewritten"`
+}
+
+// captureStore is a bounded in-memory ring buffer of Captures, with optional
+// mirroring to disk. It is written to from the proxy's own goroutines, so
+// access is guarded by a mutex.
+type captureStore struct {
+	mu       sync.Mutex
+	items    []*Capture
+	next     int
+	size     int
+	capacity int
+	dir      string
+	seq      uint64
+}
+
+// newCaptureStore creates a ring buffer holding up to capacity captures
+// (defaulting to 200), optionally mirroring each one as JSON under dir.
+func newCaptureStore(capacity int, dir string) *captureStore {
+	if capacity <= 0 {
+		capacity = 200
+	}
+
+	return &captureStore{
+		items:    make([]*Capture, capacity),
+		capacity: capacity,
+		dir:      dir,
+	}
+}
+
+// nextID returns a monotonically increasing, process-unique capture ID.
+func (c *captureStore) nextID() string {
+	seq := atomic.AddUint64(&c.seq, 1)
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + strconv.FormatUint(seq, 10)
+}
+
+func (c *captureStore) add(item *Capture) {
+	c.mu.Lock()
+	c.items[c.next] = item
+	c.next = (c.next + 1) % c.capacity
+
+	if c.size < c.capacity {
+		c.size++
+	}
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		go c.persist(item)
+	}
+}
+
+func (c *captureStore) persist(item *Capture) {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(c.dir, item.ID+".json"), b, 0o644)
+}
+
+// list returns the stored captures, most recent first.
+func (c *captureStore) list() []*Capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]*Capture, 0, c.size)
+
+	for i := 0; i < c.size; i++ {
+		idx := (c.next - 1 - i + c.capacity) % c.capacity
+		out = append(out, c.items[idx])
+	}
+
+	return out
+}
+
+func (c *captureStore) get(id string) *Capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, item := range c.items {
+		if item != nil && item.ID == id {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// captureState is threaded through the request context so UpdateResponse can
+// later pair the response it sees with the request body and start time
+// UpdateRequest observed.
+type captureState struct {
+	start time.Time
+	body  []byte
+}
+
+type captureStateKey struct{}
+
+func withCaptureState(ctx context.Context, s captureState) context.Context {
+	return context.WithValue(ctx, captureStateKey{}, s)
+}
+
+func captureStateFrom(ctx context.Context) (captureState, bool) {
+	s, ok := ctx.Value(captureStateKey{}).(captureState)
+	return s, ok
+}
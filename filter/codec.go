@@ -0,0 +1,217 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// supportedEncodings lists the content encodings villip knows how to decode
+// and re-encode; clampAcceptEncoding keeps only these, in the client's order.
+var supportedEncodings = []string{"gzip", "br", "deflate"}
+
+// decode returns a reader yielding the uncompressed bytes of body according
+// to the Content-Encoding header value. Content-Encoding may list several
+// encodings ("gzip, br"), applied left to right as per RFC 7231, so the
+// readers are chained with the rightmost (last applied, outermost) first.
+func decode(encoding string, body io.Reader) (io.Reader, error) {
+	encodings := splitEncodings(encoding)
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip":
+			r, err := gzip.NewReader(body)
+			if err != nil {
+				return nil, fmt.Errorf("gzip decode: %w", err)
+			}
+
+			body = r
+		case "br":
+			body = brotli.NewReader(body)
+		case "deflate":
+			r, err := newDeflateReader(body)
+			if err != nil {
+				return nil, fmt.Errorf("deflate decode: %w", err)
+			}
+
+			body = r
+		case "identity", "":
+			// no-op, bytes are already plain
+		default:
+			return nil, fmt.Errorf("unsupported content-encoding: %s", encodings[i])
+		}
+	}
+
+	return body, nil
+}
+
+// newDeflateReader returns a reader yielding the decompressed bytes of body,
+// which may be either zlib-wrapped deflate (RFC 1950, what "deflate" is
+// supposed to mean) or raw deflate (RFC 1951, what some servers send
+// instead). It peeks the first two bytes to tell them apart rather than
+// trying zlib.NewReader first and falling back on error: zlib.NewReader
+// already consumes body's zlib header before it can fail, so a body that
+// turns out to be raw deflate would have its first bytes missing by the
+// time flate.NewReader saw it.
+func newDeflateReader(body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+
+	head, err := br.Peek(2)
+	if err == nil && isZlibHeader(head) {
+		return zlib.NewReader(br)
+	}
+
+	return flate.NewReader(br), nil
+}
+
+// isZlibHeader reports whether the first two bytes of a stream look like a
+// valid zlib header (RFC 1950): a deflate compression method in the low
+// nibble of the first byte, and a checksum formed by both bytes read as a
+// big-endian uint16 that is a multiple of 31.
+func isZlibHeader(head []byte) bool {
+	if len(head) < 2 {
+		return false
+	}
+
+	cmf, flg := head[0], head[1]
+
+	return cmf&0x0f == 8 && (uint16(cmf)*256+uint16(flg))%31 == 0
+}
+
+// encode compresses s with the encodings named by encoding, applied left to
+// right, and returns the resulting buffer. An empty or "identity" encoding
+// returns s unmodified.
+func encode(encoding string, s string) (*bytes.Buffer, error) {
+	var w bytes.Buffer
+
+	wc, err := newEncodeWriter(encoding, &w)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(wc, s); err != nil {
+		return nil, err
+	}
+
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// newEncodeWriter wraps w so that whatever is written to the result comes
+// out the other side compressed with the encodings named by encoding,
+// applied left to right (RFC 7231: the first-listed encoding is applied
+// first, then the next is applied to its output, and so on). That means the
+// writer chain has to be built in the opposite, rightmost-first order: the
+// last-applied encoding wraps w directly and the first-listed one is the
+// writer callers write to -- the mirror image of decode()'s rightmost-first
+// reader chain. Closing the
+// result flushes and closes every layer. An empty or "identity" encoding
+// returns w wrapped in a no-op closer.
+func newEncodeWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	encodings := splitEncodings(encoding)
+
+	var writer io.Writer = w
+
+	var closers []io.Closer
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip":
+			cw := gzip.NewWriter(writer)
+			writer, closers = cw, append(closers, cw)
+		case "br":
+			cw := brotli.NewWriter(writer)
+			writer, closers = cw, append(closers, cw)
+		case "deflate":
+			cw := zlib.NewWriter(writer)
+			writer, closers = cw, append(closers, cw)
+		case "identity", "":
+			// no-op
+		default:
+			return nil, fmt.Errorf("unsupported content-encoding: %s", encodings[i])
+		}
+	}
+
+	return multiCloser{Writer: writer, closers: closers}, nil
+}
+
+// multiCloser closes every layered compressor from outermost to innermost,
+// since each one only flushes into the writer beneath it, not all the way
+// down to the underlying buffer or socket.
+type multiCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (m multiCloser) Close() error {
+	for i := len(m.closers) - 1; i >= 0; i-- {
+		if err := m.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitEncodings parses a Content-Encoding (or Accept-Encoding) header value
+// into its individual, trimmed tokens, dropping any quality parameters.
+func splitEncodings(encoding string) []string {
+	if encoding == "" {
+		return nil
+	}
+
+	parts := strings.Split(encoding, ",")
+	encodings := make([]string, 0, len(parts))
+
+	for _, p := range parts {
+		if i := strings.IndexByte(p, ';'); i != -1 {
+			p = p[:i]
+		}
+
+		p = strings.TrimSpace(p)
+		if p != "" {
+			encodings = append(encodings, p)
+		}
+	}
+
+	return encodings
+}
+
+// clampAcceptEncoding rewrites an Accept-Encoding header value so that it only
+// advertises encodings villip can later decode, preserving the client's
+// relative preference. An empty result means "identity only".
+func clampAcceptEncoding(encoding string) string {
+	if encoding == "" {
+		return ""
+	}
+
+	parts := strings.Split(encoding, ",")
+	kept := make([]string, 0, len(parts))
+
+	for _, p := range parts {
+		name := splitEncodings(p)
+		if len(name) == 0 {
+			continue
+		}
+
+		for _, s := range supportedEncodings {
+			if name[0] == s {
+				// Keep the whole token so its quality value survives.
+				kept = append(kept, strings.TrimSpace(p))
+				break
+			}
+		}
+	}
+
+	return strings.Join(kept, ", ")
+}
@@ -0,0 +1,100 @@
+package filter
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	cases := []string{"", "gzip", "br", "deflate", "gzip, br"}
+
+	for _, encoding := range cases {
+		want := "hello, villip: " + encoding
+
+		buf, err := encode(encoding, want)
+		if err != nil {
+			t.Fatalf("encode(%q): %v", encoding, err)
+		}
+
+		r, err := decode(encoding, buf)
+		if err != nil {
+			t.Fatalf("decode(%q): %v", encoding, err)
+		}
+
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading decoded body for %q: %v", encoding, err)
+		}
+
+		if string(got) != want {
+			t.Fatalf("round trip for %q: got %q, want %q", encoding, got, want)
+		}
+	}
+}
+
+// TestDecodeDeflateRaw makes sure a raw (non zlib-wrapped) deflate stream --
+// what some servers send for "Content-Encoding: deflate" -- still decodes
+// correctly. A decode() that tries zlib.NewReader first and falls back to
+// flate.NewReader on the same reader would have already consumed the first
+// bytes before the fallback runs.
+func TestDecodeDeflateRaw(t *testing.T) {
+	want := "raw deflate, no zlib header here"
+
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatalf("flate.NewWriter: %v", err)
+	}
+
+	if _, err := w.Write([]byte(want)); err != nil {
+		t.Fatalf("writing raw deflate: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing raw deflate writer: %v", err)
+	}
+
+	r, err := decode("deflate", &buf)
+	if err != nil {
+		t.Fatalf("decode(deflate) on raw stream: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading decoded raw deflate body: %v", err)
+	}
+
+	if string(got) != want {
+		t.Fatalf("raw deflate round trip: got %q, want %q", got, want)
+	}
+}
+
+// TestNewEncodeWriterOrder checks that "gzip, br" (applied left to right per
+// RFC 7231: gzip first, then br over gzip's output) round-trips through
+// decode(), which expects exactly that nesting. A writer chain built in the
+// wrong order would produce bytes decode() can't make sense of.
+func TestNewEncodeWriterOrder(t *testing.T) {
+	want := "order-sensitive payload"
+
+	buf, err := encode("gzip, br", want)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	decoded, err := decode("gzip, br", buf)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		t.Fatalf("reading decoded body: %v", err)
+	}
+
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
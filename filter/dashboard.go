@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EnableCaptureDashboard turns on the capture/replay pipeline: every
+// filtered response is recorded into a bounded ring buffer of capacity
+// entries (mirrored as JSON under dumpDir when set) and the dashboard is
+// served on addr, on its own listener separate from the proxied traffic.
+// Call it once while setting up a Filter; a nil f.captures (the default)
+// leaves capturing off entirely.
+func (f *Filter) EnableCaptureDashboard(addr string, capacity int, dumpDir string) error {
+	f.captures = newCaptureStore(capacity, dumpDir)
+
+	d := newDashboard(f, f.captures)
+
+	go func() {
+		if err := d.ListenAndServe(addr); err != nil {
+			f.log.WithField("addr", addr).WithError(err).Error("capture dashboard stopped")
+		}
+	}()
+
+	return nil
+}
+
+// dashboard serves the capture/replay admin UI on its own listener, kept
+// separate from the proxied traffic so it is never reachable through f.url.
+type dashboard struct {
+	store *captureStore
+	proxy *Filter
+	log   *logrus.Entry
+}
+
+func newDashboard(f *Filter, store *captureStore) *dashboard {
+	return &dashboard{store: store, proxy: f, log: f.log.WithField("component", "dashboard")}
+}
+
+// ListenAndServe starts the admin HTTP server. It blocks, so callers run it
+// in its own goroutine, the same way the main proxy listener is started.
+func (d *dashboard) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/captures", d.handleList)
+	mux.HandleFunc("/api/captures/", d.handleItem)
+
+	d.log.WithField("addr", addr).Info("starting capture dashboard")
+
+	return http.ListenAndServe(addr, mux)
+}
+
+// handleList answers GET /api/captures with the most recent captures first.
+func (d *dashboard) handleList(w http.ResponseWriter, r *http.Request) {
+	items := d.store.list()
+	summaries := make([]DashboardItem, 0, len(items))
+
+	for _, c := range items {
+		summaries = append(summaries, DashboardItem{
+			ID:        c.ID,
+			Method:    c.Method,
+			URL:       c.URL,
+			Status:    c.Status,
+			ElapsedMS: c.ElapsedMS,
+			Timestamp: c.Timestamp,
+			Rewritten: !bytes.Equal(c.ResponseBodyBefore, c.ResponseBodyAfter),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summaries)
+}
+
+// handleItem answers GET /api/captures/{id} with the full capture (for the
+// diff view) and POST /api/captures/{id}/replay by re-issuing the request.
+func (d *dashboard) handleItem(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/captures/")
+	id = strings.TrimSuffix(id, "/replay")
+
+	item := d.store.get(id)
+	if item == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/replay") {
+		d.replay(w, item)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(item)
+}
+
+// replay re-issues the captured request against the upstream and streams the
+// fresh response straight back to the dashboard caller.
+func (d *dashboard) replay(w http.ResponseWriter, item *Capture) {
+	req, err := http.NewRequest(item.Method, strings.TrimSuffix(d.proxy.url, "/")+item.Path, bytes.NewReader(item.RequestBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	req.Header = item.RequestHeader.Clone()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dumpSeq makes newDumpID unique within the process, the same role
+// captureStore.seq plays for capture IDs.
+var dumpSeq uint64
+
+// dumpResponse writes body to disk under f.dumpFolder for offline
+// before/after inspection. UpdateResponse calls it twice for the same
+// response: once with requestID == "" before rewriting, and once with the ID
+// that call returned after rewriting, so the two files can be diffed. If
+// f.dumpURLs is non-empty, only requestURL values containing one of its
+// entries are dumped, the same substring match toFilter uses for
+// contentTypes. It returns the requestID to pass back in for the paired
+// call; an empty return means nothing was written.
+func (f *Filter) dumpResponse(requestID, requestURL string, header http.Header, body string) string {
+	if len(f.dumpURLs) != 0 {
+		matched := false
+
+		for _, u := range f.dumpURLs {
+			if strings.Contains(requestURL, u) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return requestID
+		}
+	}
+
+	if f.dumpFolder == "" {
+		return requestID
+	}
+
+	phase := "after"
+
+	if requestID == "" {
+		requestID = newDumpID()
+		phase = "before"
+	}
+
+	var out strings.Builder
+	out.WriteString("URL: " + requestURL + "\n")
+	out.WriteString("Content-Type: " + header.Get("Content-Type") + "\n\n")
+	out.WriteString(body)
+
+	name := requestID + "-" + phase + ".txt"
+	_ = ioutil.WriteFile(filepath.Join(f.dumpFolder, name), []byte(out.String()), 0o644)
+
+	return requestID
+}
+
+// newDumpID returns a monotonically increasing, process-unique dump ID,
+// following the same scheme captureStore.nextID uses for capture IDs.
+func newDumpID() string {
+	seq := atomic.AddUint64(&dumpSeq, 1)
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + strconv.FormatUint(seq, 10)
+}
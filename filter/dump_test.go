@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpResponseWritesBeforeAndAfter(t *testing.T) {
+	dir := t.TempDir()
+	f := &Filter{dumpFolder: dir}
+
+	header := http.Header{"Content-Type": []string{"text/plain"}}
+
+	id := f.dumpResponse("", "/some/path", header, "before body")
+	if id == "" {
+		t.Fatal("expected a non-empty requestID")
+	}
+
+	got := f.dumpResponse(id, "/some/path", header, "after body")
+	if got != id {
+		t.Fatalf("second call returned %q, want the same id %q", got, id)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading dump dir: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 dump files, got %d", len(entries))
+	}
+
+	before, err := os.ReadFile(filepath.Join(dir, id+"-before.txt"))
+	if err != nil {
+		t.Fatalf("reading before dump: %v", err)
+	}
+
+	if !strings.Contains(string(before), "before body") {
+		t.Fatalf("before dump missing body, got %q", before)
+	}
+
+	after, err := os.ReadFile(filepath.Join(dir, id+"-after.txt"))
+	if err != nil {
+		t.Fatalf("reading after dump: %v", err)
+	}
+
+	if !strings.Contains(string(after), "after body") {
+		t.Fatalf("after dump missing body, got %q", after)
+	}
+}
+
+// TestDumpResponseRestrictedByURL checks that a non-empty dumpURLs only
+// dumps matching requestURLs, and leaves everything else untouched.
+func TestDumpResponseRestrictedByURL(t *testing.T) {
+	dir := t.TempDir()
+	f := &Filter{dumpFolder: dir, dumpURLs: []string{"/api/"}}
+
+	header := http.Header{}
+
+	if id := f.dumpResponse("", "/static/app.js", header, "body"); id != "" {
+		t.Fatalf("expected no dump for an unmatched URL, got id %q", id)
+	}
+
+	if id := f.dumpResponse("", "/api/users", header, "body"); id == "" {
+		t.Fatal("expected a dump for a matched URL")
+	}
+}
@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// replace describes one from/to body rewrite rule, optionally restricted to
+// a Host pattern (e.g. "*.example.com") and/or a set of URL path regexes.
+type replace struct {
+	Host string
+	from string
+	to   string
+	urls []*regexp.Regexp
+
+	// Mode overrides rules.Mode for whichever response this rule's Host/urls
+	// scope matches, letting one Filter mix e.g. JSON-mode rules for an API
+	// host with HTML-mode rules for everything else. Empty keeps the
+	// response-wide Mode.
+	Mode string
+
+	// Path scopes this rule to JSON string leaves reached by this
+	// dot-separated key path (e.g. "data.items"), instead of every string
+	// leaf in the document. Only meaningful when the response is rewritten
+	// in "json" mode; empty applies the rule to every string leaf, array
+	// indexes don't add a path segment.
+	Path string
+}
+
+// header describes one header to force/set on the request or response side,
+// optionally restricted to a Host pattern.
+type header struct {
+	Host  string
+	Name  string
+	Value string
+	Force bool
+}
+
+// rules groups the replace/header rules configured for one side (request or
+// response) of the proxy.
+type rules struct {
+	Replace []replace
+	Header  []header
+
+	// Mode picks the body Rewriter ("raw", "json", "html", or "auto" to
+	// resolve from Content-Type) applied when none of Replace's own
+	// per-rule Mode overrides match; see Filter.modeFor.
+	Mode string
+}
+
+// Filter holds everything villip needs to proxy and rewrite one upstream's
+// traffic: the rewrite rules, the access/content-type policy, and the
+// upstream itself.
+type Filter struct {
+	url          string
+	force        bool
+	contentTypes []string
+	restricted   []*net.IPNet
+	dumpFolder   string
+	dumpURLs     []string
+	request      rules
+	response     rules
+	log          *logrus.Entry
+
+	// captures holds the capture/replay ring buffer when the dashboard is
+	// enabled; nil means capturing is off.
+	captures *captureStore
+
+	// vhosts routes an incoming Host header to the upstream URL it should be
+	// proxied to; an empty list keeps the single-backend behaviour of
+	// always proxying to url.
+	vhosts []VHost
+
+	// maxBodyBytes caps how much of a response body filtering will process;
+	// zero (the default) means no cap.
+	maxBodyBytes int64
+
+	// auth configures the proxy-auth stage enforced in RoundTrip; nil (the
+	// default) disables it. restricted doubles as its bypass allowlist.
+	auth *AuthConfig
+
+	// transport is the RoundTripper Filter delegates to once a request is
+	// authorized; nil falls back to http.DefaultTransport.
+	transport http.RoundTripper
+}
@@ -2,7 +2,6 @@ package filter
 
 import (
 	"bytes"
-	"compress/gzip"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io"
@@ -11,26 +10,13 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func (f *Filter) do(url string, s string) string {
-	for _, r := range f.response.Replace {
-		if len(r.urls) != 0 {
-			found := false
-
-			for _, reg := range r.urls {
-				if reg.MatchString(url) {
-					found = true
-					break
-				}
-			}
-
-			if !found {
-				continue
-			}
-		}
-
+func (f *Filter) do(host, url, s string) string {
+	for _, r := range matchingReplaceRules(f.response.Replace, host, url) {
 		s = strings.Replace(s, r.from, r.to, -1)
 	}
 
@@ -54,57 +40,190 @@ func (f *Filter) UpdateResponse(r *http.Response) error {
 
 	requestLog.Debug("filtering")
 
+	if f.maxBodyBytes > 0 {
+		if cl := r.Header.Get("Content-Length"); cl != "" {
+			if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n > f.maxBodyBytes {
+				requestLog.WithFields(logrus.Fields{"contentLength": n, "max": f.maxBodyBytes}).Debug("response exceeds MaxBodyBytes, passing through untouched")
+				return nil
+			}
+		}
+	}
+
+	host := originalHost(r.Request.Context())
+	if host == "" {
+		host = r.Request.Host
+	}
+
+	requestURL := strings.TrimPrefix(r.Request.URL.String(), f.url)
+
+	contentType := r.Header.Get("Content-Type")
+	mode := f.modeFor(host, requestURL)
+	structural := isStructuralMode(mode, contentType)
+
+	// Dumps and captures need the whole before/after body to diff and
+	// store, and a structural (json/html) rewrite needs the whole body
+	// parsed at once, so all three keep using the buffered path below;
+	// everything else takes the streaming path to avoid materializing
+	// large bodies.
+	if f.dumpFolder == "" && len(f.dumpURLs) == 0 && f.captures == nil && !structural {
+		return f.streamResponse(requestLog, r, host)
+	}
+
+	if f.maxBodyBytes > 0 {
+		capped, rewriting, err := capBody(r.Body, f.maxBodyBytes)
+		if err != nil {
+			return err
+		}
+
+		r.Body = capped
+
+		if !rewriting {
+			requestLog.WithField("max", f.maxBodyBytes).Debug("response exceeds MaxBodyBytes, passing through untouched")
+			return nil
+		}
+	}
+
 	s, err := f.readBody(r.Body, r.Header)
 	if err != nil {
 		return err
 	}
 
-	requestURL := strings.TrimPrefix(r.Request.URL.String(), f.url)
+	before := s
 
 	requestID := ""
 	if f.dumpFolder != "" || len(f.dumpURLs) != 0 {
 		requestID = f.dumpResponse(requestID, requestURL, r.Header, s)
 	}
 
-	s = f.do(requestURL, s)
+	s = rewriterFor(mode, contentType).Rewrite(host, requestURL, s, f)
 
 	requestLog.WithFields(logrus.Fields{"requestID": requestID}).Debug("will rewrite content")
 
-	f.location(requestLog, r, requestURL)
+	f.location(requestLog, r, host, requestURL)
 
 	if requestID != "" {
 		f.dumpResponse(requestID, requestURL, r.Header, s)
 	}
 
-	switch r.Header.Get("Content-Encoding") {
-	case "gzip":
-		w, err := f.compress(s)
+	if f.captures != nil {
+		f.recordCapture(r, requestURL, before, s)
+	}
+
+	w, err := encode(r.Header.Get("Content-Encoding"), s)
+	if err != nil {
+		return err
+	}
+
+	r.Body = ioutil.NopCloser(w)
+	r.Header["Content-Length"] = []string{fmt.Sprint(w.Len())}
+
+	if len(f.response.Header) > 0 {
+		r.Header = f.headerReplace(requestLog, r.Header, host, "response")
+	}
+
+	return nil
+}
+
+// streamResponse rewrites r's body without ever holding the whole thing in
+// memory: MaxBodyBytes is enforced up front via capBody so an oversized body
+// is passed through byte-for-byte rather than truncated mid-stream, then the
+// rest decodes on the fly, scans with the Aho-Corasick automaton built from
+// the Replace rules scoped to host and requestURL, re-encodes with the
+// original Content-Encoding, and switches the response to chunked transfer
+// since the rewritten size isn't known up front.
+func (f *Filter) streamResponse(requestLog *logrus.Entry, r *http.Response, host string) error {
+	requestURL := strings.TrimPrefix(r.Request.URL.String(), f.url)
+
+	if f.maxBodyBytes > 0 {
+		capped, rewriting, err := capBody(r.Body, f.maxBodyBytes)
 		if err != nil {
 			return err
 		}
 
-		r.Body = ioutil.NopCloser(w)
-		r.Header["Content-Length"] = []string{fmt.Sprint(w.Len())}
+		r.Body = capped
+
+		if !rewriting {
+			requestLog.WithField("max", f.maxBodyBytes).Debug("response exceeds MaxBodyBytes, passing through untouched")
+			return nil
+		}
+	}
+
+	decoded, err := decode(r.Header.Get("Content-Encoding"), r.Body)
+	if err != nil {
+		return err
+	}
+
+	encoding := r.Header.Get("Content-Encoding")
+
+	pr, pw := io.Pipe()
 
-	default:
-		buf := bytes.NewBufferString(s)
-		r.Body = ioutil.NopCloser(buf)
-		r.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+	encWriter, err := newEncodeWriter(encoding, pw)
+	if err != nil {
+		return err
 	}
 
+	ac := f.rewriteAutomaton(host, requestURL)
+
+	go func() {
+		rewriteErr := streamRewrite(encWriter, decoded, ac)
+		if rewriteErr == nil {
+			rewriteErr = encWriter.Close()
+		}
+
+		_ = pw.CloseWithError(rewriteErr)
+	}()
+
+	r.Body = pr
+	r.Header.Del("Content-Length")
+	r.TransferEncoding = []string{"chunked"}
+
+	f.location(requestLog, r, host, requestURL)
+
 	if len(f.response.Header) > 0 {
-		r.Header = f.headerReplace(requestLog, r.Header, "response")
+		r.Header = f.headerReplace(requestLog, r.Header, host, "response")
 	}
 
 	return nil
 }
 
+// recordCapture stores a Capture for this response into f.captures, pairing
+// it with the request body and start time UpdateRequest observed.
+func (f *Filter) recordCapture(r *http.Response, requestURL, before, after string) {
+	state, _ := captureStateFrom(r.Request.Context())
+
+	elapsed := int64(0)
+	if !state.start.IsZero() {
+		elapsed = time.Since(state.start).Milliseconds()
+	}
+
+	f.captures.add(&Capture{
+		ID:                 f.captures.nextID(),
+		Proto:              r.Proto,
+		Method:             r.Request.Method,
+		URL:                r.Request.URL.String(),
+		Path:               requestURL,
+		RequestHeader:      r.Request.Header.Clone(),
+		RequestBody:        state.body,
+		ResponseHeader:     r.Header.Clone(),
+		ResponseBodyBefore: []byte(before),
+		ResponseBodyAfter:  []byte(after),
+		Status:             r.StatusCode,
+		ElapsedMS:          elapsed,
+		Timestamp:          time.Now(),
+	})
+}
+
 //UpdateRequest will be called back when the request is received by the proxy.
+// The proxy-auth stage itself runs in RoundTrip, the only hook able to
+// refuse a request before it reaches the backend; see auth.go.
 func (f *Filter) UpdateRequest(r *http.Request) {
 	requestLog := f.log.WithFields(logrus.Fields{"url": r.URL.String(), "action": "request", "source": r.RemoteAddr})
 	requestLog.Debug("Request")
 
-	u, _ := url.Parse(f.url)
+	start := time.Now()
+	originalHostHeader := r.Host
+
+	u, _ := url.Parse(f.route(originalHostHeader))
 	r.URL.Host = u.Host
 	r.Host = u.Host
 	r.URL.Scheme = "http"
@@ -116,32 +235,42 @@ func (f *Filter) UpdateRequest(r *http.Request) {
 
 	f.log.Debug(fmt.Sprintf("Request received\n %s", string(data)))
 
+	var capturedBody []byte
+
 	if r.Body != nil {
 		s, err := f.readBody(r.Body, r.Header)
 		if err != nil {
 			f.log.Fatal(err)
 		}
 
-		switch r.Header.Get("Content-Encoding") {
-		case "gzip":
-			w, _ := f.compress(s)
+		capturedBody = []byte(s)
 
-			r.Body = ioutil.NopCloser(w)
-			r.Header["Content-Length"] = []string{fmt.Sprint(w.Len())}
-
-		default:
-			buf := bytes.NewBufferString(s)
-			r.Body = ioutil.NopCloser(buf)
-			r.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+		w, err := encode(r.Header.Get("Content-Encoding"), s)
+		if err != nil {
+			f.log.Fatal(err)
 		}
+
+		r.Body = ioutil.NopCloser(w)
+		r.Header["Content-Length"] = []string{fmt.Sprint(w.Len())}
+	}
+
+	if ae := r.Header.Get("Accept-Encoding"); ae != "" {
+		r.Header.Set("Accept-Encoding", clampAcceptEncoding(ae))
 	}
 
 	if len(f.request.Header) > 0 {
-		r.Header = f.headerReplace(requestLog, r.Header, "request")
+		r.Header = f.headerReplace(requestLog, r.Header, originalHostHeader, "request")
+	}
+
+	ctx := withOriginalHost(r.Context(), originalHostHeader)
+	if f.captures != nil {
+		ctx = withCaptureState(ctx, captureState{start: start, body: capturedBody})
 	}
+
+	*r = *r.WithContext(ctx)
 }
 
-func (f *Filter) headerReplace(log *logrus.Entry, h http.Header, a string) http.Header {
+func (f *Filter) headerReplace(log *logrus.Entry, h http.Header, host, a string) http.Header {
 	log.Debug("Checking if need to replace header")
 
 	var header []header
@@ -153,6 +282,10 @@ func (f *Filter) headerReplace(log *logrus.Entry, h http.Header, a string) http.
 	}
 
 	for _, head := range header {
+		if head.Host != "" && !matchHost(head.Host, host) {
+			continue
+		}
+
 		if h[head.Name] == nil || h[head.Name][0] == "" || head.Force {
 			h.Set(head.Name, head.Value)
 			log.Debug(fmt.Sprintf("set header %s with value :  %s", head.Name, head.Value))
@@ -164,6 +297,15 @@ func (f *Filter) headerReplace(log *logrus.Entry, h http.Header, a string) http.
 
 //nolint: nestif
 func (f *Filter) isAuthorized(log *logrus.Entry, r *http.Response) (bool, error) {
+	if f.auth != nil {
+		// Access control now happens in RoundTrip's auth stage, which
+		// already reuses f.restricted as its bypass allowlist. Applying
+		// the old allowlist-only rule here too would overwrite a client's
+		// legitimate, just-authenticated response with a 403 the moment
+		// its IP isn't also in f.restricted.
+		return true, nil
+	}
+
 	if len(f.restricted) != 0 {
 		sip, _, err := net.SplitHostPort(r.Request.RemoteAddr)
 		if err != nil {
@@ -220,52 +362,24 @@ func (f *Filter) toFilter(log *logrus.Entry, r *http.Response) bool {
 }
 
 func (f *Filter) readBody(bod io.ReadCloser, h http.Header) (string, error) {
-	var body io.ReadCloser
-
-	switch h.Get("Content-Encoding") {
-	case "gzip":
-		body, _ = gzip.NewReader(bod)
-		//		defer body.Close()
-	default:
-		body = bod
-	}
-
-	b, err := ioutil.ReadAll(body)
+	body, err := decode(h.Get("Content-Encoding"), bod)
 	if err != nil {
 		return "", err
 	}
 
-	return string(b), err
-}
-
-func (f *Filter) compress(s string) (*bytes.Buffer, error) {
-	var w bytes.Buffer
-
-	compressed := gzip.NewWriter(&w)
-
-	_, err := compressed.Write([]byte(s))
-	if err != nil {
-		return nil, err
-	}
-
-	err = compressed.Flush()
-	if err != nil {
-		return nil, err
-	}
-
-	err = compressed.Close()
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return &w, nil
+	return string(b), nil
 }
 
-func (f *Filter) location(requestLog *logrus.Entry, r *http.Response, requestURL string) {
+func (f *Filter) location(requestLog *logrus.Entry, r *http.Response, host, requestURL string) {
 	location := r.Header.Get("Location")
 	if location != "" {
 		origLocation := location
-		location = f.do(requestURL, location)
+		location = f.do(host, requestURL, location)
 
 		requestLog.WithFields(logrus.Fields{"location": origLocation, "rewrited_location": location}).Debug("will rewrite location header")
 		r.Header.Set("Location", location)
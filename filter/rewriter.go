@@ -0,0 +1,302 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Rewriter rewrites a decoded response body for a single Content-Type
+// family, aware enough of its structure not to mangle an escaped JSON
+// string or an entity-encoded HTML attribute the way a flat
+// strings.Replace (do()) does.
+type Rewriter interface {
+	Rewrite(host, requestURL, body string, f *Filter) string
+}
+
+// rewriterFor picks a Rewriter for mode ("raw", "json", "html" or "auto"),
+// resolving "auto" (and anything unrecognised) from contentType, falling
+// back to the existing raw do()-based replace for content types with no
+// structural rewriter.
+func rewriterFor(mode, contentType string) Rewriter {
+	switch mode {
+	case "json":
+		return jsonRewriter{}
+	case "html":
+		return htmlRewriter{}
+	case "raw":
+		return rawRewriter{}
+	}
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		return jsonRewriter{}
+	case strings.Contains(contentType, "html"):
+		return htmlRewriter{}
+	default:
+		return rawRewriter{}
+	}
+}
+
+// modeFor resolves the body-rewrite mode for one response: the first
+// matching Replace rule (by the same Host/urls scoping do() uses) that
+// carries its own Mode wins, so a Filter fronting several vhosts can rewrite
+// one as JSON and another as HTML; with no scoped override it falls back to
+// the response-wide rules.Mode.
+func (f *Filter) modeFor(host, requestURL string) string {
+	for _, i := range matchingReplaceRuleIndexes(f.response.Replace, host, requestURL) {
+		if mode := f.response.Replace[i].Mode; mode != "" {
+			return mode
+		}
+	}
+
+	return f.response.Mode
+}
+
+// isStructuralMode reports whether mode forces (or would auto-resolve to) a
+// structural rewriter for contentType, so callers can decide up front
+// whether the whole-body buffered path is required.
+func isStructuralMode(mode, contentType string) bool {
+	switch mode {
+	case "json", "html":
+		return true
+	case "raw":
+		return false
+	default:
+		return strings.Contains(contentType, "json") || strings.Contains(contentType, "html")
+	}
+}
+
+// rawRewriter is today's behaviour: a flat, rule-ordered strings.Replace.
+type rawRewriter struct{}
+
+func (rawRewriter) Rewrite(host, requestURL, body string, f *Filter) string {
+	return f.do(host, requestURL, body)
+}
+
+// jsonRewriter walks a decoded JSON value and rewrites only string leaves,
+// so an escaped "/" or a "/" inside a JSON string is rewritten as the
+// decoded character it represents rather than as raw source bytes. A rule
+// with a Path set only rewrites leaves reached by that dot-separated key
+// path; one with no Path keeps applying everywhere, the way do() does for
+// raw/html mode.
+type jsonRewriter struct{}
+
+func (jsonRewriter) Rewrite(host, requestURL, body string, f *Filter) string {
+	var v interface{}
+
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		// Not actually valid JSON (or truncated) despite the Content-Type;
+		// rewriting the raw bytes is safer than failing the response.
+		return rawRewriter{}.Rewrite(host, requestURL, body, f)
+	}
+
+	rules := matchingReplaceRules(f.response.Replace, host, requestURL)
+
+	out, err := json.Marshal(rewriteJSONValue(v, "", rules))
+	if err != nil {
+		return rawRewriter{}.Rewrite(host, requestURL, body, f)
+	}
+
+	return string(out)
+}
+
+func rewriteJSONValue(v interface{}, path string, rules []replace) interface{} {
+	switch val := v.(type) {
+	case string:
+		return applyJSONPathRules(val, path, rules)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			// Array indexes don't add a path segment: a Path scopes a key,
+			// not a position within it.
+			out[i] = rewriteJSONValue(item, path, rules)
+		}
+
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = rewriteJSONValue(item, joinJSONPath(path, k), rules)
+		}
+
+		return out
+	default:
+		return val
+	}
+}
+
+// applyJSONPathRules runs s through every rule in rules whose Path is either
+// empty (applies everywhere) or an exact match for path.
+func applyJSONPathRules(s, path string, rules []replace) string {
+	for _, r := range rules {
+		if r.Path != "" && r.Path != path {
+			continue
+		}
+
+		s = strings.Replace(s, r.from, r.to, -1)
+	}
+
+	return s
+}
+
+// joinJSONPath appends key to the dot-separated path parent, the way
+// "data.items" names the "items" key inside the top-level "data" object.
+func joinJSONPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+
+	return parent + "." + key
+}
+
+// htmlRewriter parses the body as HTML and rewrites the URL-bearing
+// attributes a flat string replace would otherwise corrupt once they're
+// entity-encoded or split across a srcset list.
+type htmlRewriter struct{}
+
+// urlAttrs lists, per tag, which attributes carry a URL to rewrite.
+var urlAttrs = map[string][]string{
+	"a":      {"href"},
+	"link":   {"href"},
+	"script": {"src"},
+	"img":    {"src", "srcset"},
+	"source": {"src", "srcset"},
+	"form":   {"action"},
+	"base":   {"href"},
+	"iframe": {"src"},
+}
+
+// cssURLRe matches a CSS url(...) reference with its quoting (single,
+// double, or none) as three mutually exclusive capture groups, rather than a
+// backreference: Go's RE2-based regexp package doesn't support those.
+var cssURLRe = regexp.MustCompile(`url\(\s*(?:'([^']*)'|"([^"]*)"|([^'")]*))\s*\)`)
+
+func (htmlRewriter) Rewrite(host, requestURL, body string, f *Filter) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return rawRewriter{}.Rewrite(host, requestURL, body, f)
+	}
+
+	var walk func(*html.Node)
+
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			rewriteElementAttrs(n, host, requestURL, f)
+
+			if n.DataAtom == atom.Style {
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type == html.TextNode {
+						c.Data = rewriteCSSURLs(c.Data, host, requestURL, f)
+					}
+				}
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	walk(doc)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return rawRewriter{}.Rewrite(host, requestURL, body, f)
+	}
+
+	return buf.String()
+}
+
+func rewriteElementAttrs(n *html.Node, host, requestURL string, f *Filter) {
+	wanted := urlAttrs[n.Data]
+
+	for i, a := range n.Attr {
+		switch {
+		case strings.EqualFold(a.Key, "style"):
+			n.Attr[i].Val = rewriteCSSURLs(a.Val, host, requestURL, f)
+		case n.DataAtom == atom.Meta && strings.EqualFold(a.Key, "content") && hasHTTPEquivRefresh(n):
+			n.Attr[i].Val = rewriteRefresh(a.Val, host, requestURL, f)
+		case a.Key == "srcset" && containsAttr(wanted, "srcset"):
+			n.Attr[i].Val = rewriteSrcset(a.Val, host, requestURL, f)
+		case containsAttr(wanted, a.Key):
+			n.Attr[i].Val = f.do(host, requestURL, a.Val)
+		}
+	}
+}
+
+func containsAttr(attrs []string, key string) bool {
+	for _, a := range attrs {
+		if a == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasHTTPEquivRefresh(n *html.Node) bool {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, "http-equiv") && strings.EqualFold(a.Val, "refresh") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewriteRefresh rewrites the URL in a `<meta http-equiv=refresh
+// content="N;url=...">` value, leaving the delay prefix untouched.
+func rewriteRefresh(content, host, requestURL string, f *Filter) string {
+	semi := strings.IndexByte(content, ';')
+	if semi == -1 {
+		return content
+	}
+
+	prefix, rest := content[:semi+1], content[semi+1:]
+
+	eq := strings.Index(strings.ToLower(rest), "url=")
+	if eq == -1 {
+		return content
+	}
+
+	return prefix + rest[:eq+4] + f.do(host, requestURL, rest[eq+4:])
+}
+
+// rewriteSrcset rewrites each URL in a comma-separated srcset list while
+// preserving each entry's " 2x" / " 480w" descriptor.
+func rewriteSrcset(val, host, requestURL string, f *Filter) string {
+	parts := strings.Split(val, ",")
+
+	for i, part := range parts {
+		fields := strings.SplitN(strings.TrimSpace(part), " ", 2)
+		fields[0] = f.do(host, requestURL, fields[0])
+		parts[i] = strings.Join(fields, " ")
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// rewriteCSSURLs rewrites every url(...) reference inside an inline <style>
+// block or a style="" attribute.
+func rewriteCSSURLs(css, host, requestURL string, f *Filter) string {
+	return cssURLRe.ReplaceAllStringFunc(css, func(m string) string {
+		// Submatch indexes, not FindStringSubmatch's empty-string values,
+		// are the only reliable way to tell "matched the single-quote
+		// branch with an empty URL" from "didn't match that branch at all".
+		idx := cssURLRe.FindStringSubmatchIndex(m)
+
+		switch {
+		case idx[2] != -1:
+			return "url('" + f.do(host, requestURL, m[idx[2]:idx[3]]) + "')"
+		case idx[4] != -1:
+			return `url("` + f.do(host, requestURL, m[idx[4]:idx[5]]) + `")`
+		default:
+			return "url(" + f.do(host, requestURL, m[idx[6]:idx[7]]) + ")"
+		}
+	})
+}
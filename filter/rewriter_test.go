@@ -0,0 +1,181 @@
+package filter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func newTestFilter(replaces ...replace) *Filter {
+	return &Filter{response: rules{Replace: replaces}}
+}
+
+// TestJSONRewriterEscapedSlash is the escape-sensitive case a flat
+// strings.Replace on raw JSON source would get wrong: the "/" in the
+// decoded string is a plain slash, never the two-character "\/" some JSON
+// encoders (though not encoding/json) emit, and the rule must match the
+// decoded form.
+func TestJSONRewriterEscapedSlash(t *testing.T) {
+	f := newTestFilter(replace{from: "http://old.example.com", to: "http://new.example.com"})
+
+	body := `{"link": "http:\/\/old.example.com\/path?a=1&b=2", "note": "unrelated"}`
+
+	got := jsonRewriter{}.Rewrite("host", "/", body, f)
+
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Fatalf("rewritten body isn't valid JSON: %v (%s)", err, got)
+	}
+
+	if want := "http://new.example.com/path?a=1&b=2"; decoded["link"] != want {
+		t.Fatalf("link: got %q, want %q", decoded["link"], want)
+	}
+
+	if decoded["note"] != "unrelated" {
+		t.Fatalf("note should be untouched, got %q", decoded["note"])
+	}
+}
+
+// TestJSONRewriterPathScoping is the regression test for the "optionally
+// scoped by JSONPath" request: a rule with a Path only rewrites leaves
+// reached by that exact key path, not every string leaf in the document.
+func TestJSONRewriterPathScoping(t *testing.T) {
+	f := newTestFilter(replace{from: "x", to: "Y", Path: "data.items"})
+
+	body := `{"data": {"items": "x marks the spot"}, "other": "x is also here"}`
+
+	got := jsonRewriter{}.Rewrite("host", "/", body, f)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Fatalf("rewritten body isn't valid JSON: %v (%s)", err, got)
+	}
+
+	data := decoded["data"].(map[string]interface{})
+	if got, want := data["items"], "Y marks the spot"; got != want {
+		t.Fatalf("data.items: got %q, want %q", got, want)
+	}
+
+	if got, want := decoded["other"], "x is also here"; got != want {
+		t.Fatalf("other (out of scope) should be untouched: got %q, want %q", got, want)
+	}
+}
+
+// TestJSONRewriterPathScopingThroughArray checks that an array doesn't add a
+// path segment, so a Path scoped to "items" still reaches string leaves
+// inside an array at that key.
+func TestJSONRewriterPathScopingThroughArray(t *testing.T) {
+	f := newTestFilter(replace{from: "x", to: "Y", Path: "items"})
+
+	body := `{"items": ["x1", "x2"], "other": "x3"}`
+
+	got := jsonRewriter{}.Rewrite("host", "/", body, f)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Fatalf("rewritten body isn't valid JSON: %v (%s)", err, got)
+	}
+
+	items := decoded["items"].([]interface{})
+	if items[0] != "Y1" || items[1] != "Y2" {
+		t.Fatalf("items: got %v, want [Y1 Y2]", items)
+	}
+
+	if decoded["other"] != "x3" {
+		t.Fatalf("other (out of scope) should be untouched, got %v", decoded["other"])
+	}
+}
+
+// TestModeForPerRuleOverride is the regression test for mixing modes on a
+// single Filter: a rule scoped to one Host with its own Mode should win over
+// the response-wide Mode for that Host, and leave other hosts on the
+// response-wide default.
+func TestModeForPerRuleOverride(t *testing.T) {
+	f := newTestFilter(replace{Host: "api.example.com", Mode: "json"})
+	f.response.Mode = "html"
+
+	if got, want := f.modeFor("api.example.com", "/"), "json"; got != want {
+		t.Fatalf("api.example.com: got %q, want %q", got, want)
+	}
+
+	if got, want := f.modeFor("www.example.com", "/"), "html"; got != want {
+		t.Fatalf("www.example.com: got %q, want %q", got, want)
+	}
+}
+
+// TestHTMLRewriterEntityEncodedAttr is the escape-sensitive HTML case: an
+// attribute value with an entity-encoded "&amp;" must be rewritten against
+// its decoded form ("&"), and come back out still properly encoded.
+func TestHTMLRewriterEntityEncodedAttr(t *testing.T) {
+	f := newTestFilter(replace{from: "a=1&b=2", to: "a=9&b=9"})
+
+	body := `<a href="/go?a=1&amp;b=2">link</a>`
+
+	got := htmlRewriter{}.Rewrite("host", "/", body, f)
+
+	if !strings.Contains(got, `href="/go?a=9&amp;b=9"`) {
+		t.Fatalf("expected rewritten, entity-encoded href, got %q", got)
+	}
+}
+
+// TestHTMLRewriterSrcset checks each URL in a srcset list is rewritten
+// independently while its size descriptor is preserved.
+func TestHTMLRewriterSrcset(t *testing.T) {
+	f := newTestFilter(replace{from: "old.example.com", to: "new.example.com"})
+
+	body := `<img srcset="http://old.example.com/a.png 1x, http://old.example.com/b.png 2x">`
+
+	got := htmlRewriter{}.Rewrite("host", "/", body, f)
+
+	if !strings.Contains(got, "http://new.example.com/a.png 1x") || !strings.Contains(got, "http://new.example.com/b.png 2x") {
+		t.Fatalf("expected both srcset entries rewritten, got %q", got)
+	}
+}
+
+// TestRewriteCSSURLs drives cssURLRe through a <style> block and a style=""
+// attribute, covering all three quoting forms url(...) allows. This is the
+// regression test for the backreference cssURLRe used to contain: RE2
+// doesn't support backreferences, so the old pattern panicked at package
+// init, before any test body ever ran.
+func TestRewriteCSSURLs(t *testing.T) {
+	f := newTestFilter(replace{from: "old.example.com", to: "new.example.com"})
+
+	cases := []struct {
+		name string
+		css  string
+		want string
+	}{
+		{"single-quoted", `url('http://old.example.com/a.png')`, `url('http://new.example.com/a.png')`},
+		{"double-quoted", `url("http://old.example.com/b.png")`, `url("http://new.example.com/b.png")`},
+		{"unquoted", `url(http://old.example.com/c.png)`, `url(http://new.example.com/c.png)`},
+		{"empty single-quoted", `url('')`, `url('')`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := rewriteCSSURLs(c.css, "host", "/", f); got != c.want {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// TestHTMLRewriterInlineStyleAndAttr checks cssURLRe is actually wired up
+// through both an inline <style> block and a style="" attribute, not just
+// exercised directly.
+func TestHTMLRewriterInlineStyleAndAttr(t *testing.T) {
+	f := newTestFilter(replace{from: "old.example.com", to: "new.example.com"})
+
+	body := `<html><head><style>body { background: url("http://old.example.com/bg.png"); }</style></head>` +
+		`<body><div style="background-image: url(http://old.example.com/div.png)"></div></body></html>`
+
+	got := htmlRewriter{}.Rewrite("host", "/", body, f)
+
+	if !strings.Contains(got, `url("http://new.example.com/bg.png")`) {
+		t.Fatalf("expected <style> block url(...) rewritten, got %q", got)
+	}
+
+	if !strings.Contains(got, "url(http://new.example.com/div.png)") {
+		t.Fatalf("expected style=\"\" url(...) rewritten, got %q", got)
+	}
+}
@@ -0,0 +1,317 @@
+package filter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultChunkSize is how much of the body the streaming rewriter pulls from
+// the upstream reader at a time.
+const defaultChunkSize = 32 * 1024
+
+// multiReadCloser pairs a Reader rebuilt from several pieces with the
+// original body's Closer, so closing it still releases the real underlying
+// connection/file even though Read no longer goes through the original
+// Reader directly.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// capBody enforces MaxBodyBytes up front instead of mid-stream: it reads up
+// to limit+1 bytes of body. If that's the whole body, those bytes are
+// returned as a fresh reader (rewriting == true) and the caller goes on to
+// filter them. If there's more, filtering is
+// skipped entirely and the exact original byte stream -- the bytes already
+// read plus whatever's left of body -- is reconstructed and handed back
+// unfiltered, which is the only way to guarantee a clean passthrough for a
+// chunked/unknown-length body: a cap enforced while writing the rewritten
+// output has no way to undo a rewrite already flushed to the client.
+func capBody(body io.ReadCloser, limit int64) (out io.ReadCloser, rewriting bool, err error) {
+	buf := make([]byte, limit+1)
+
+	n, err := io.ReadFull(body, buf)
+	switch err {
+	case nil:
+		// Read filled the buffer: there's at least one more byte than limit
+		// allows, so the cap is exceeded.
+		return multiReadCloser{Reader: io.MultiReader(bytes.NewReader(buf[:n]), body), Closer: body}, false, nil
+	case io.ErrUnexpectedEOF, io.EOF:
+		return ioutil.NopCloser(bytes.NewReader(buf[:n])), true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// acNode is one state of the Aho-Corasick trie built over every configured
+// Replace.from string.
+type acNode struct {
+	children map[byte]int
+	fail     int
+	outputs  []int // indexes into ahoCorasick.patterns/replace ending at this node
+}
+
+// ahoCorasick matches a fixed set of needles over a byte stream in a single
+// pass, so the streaming rewriter doesn't need one strings.Replace per rule.
+type ahoCorasick struct {
+	nodes    []acNode
+	patterns []string
+	replace  []string
+	maxLen   int
+}
+
+// newAhoCorasick builds the automaton once from every Replace rule's from/to
+// pair. Matches are taken in a single pass, at the earliest position where a
+// needle ends; when several needles end there, the lowest rule index wins.
+// Unlike do()'s sequential strings.Replace loop, a replacement's output is
+// never rescanned by later rules, and a longer needle loses to a shorter one
+// that ends before it.
+func newAhoCorasick(from, to []string) *ahoCorasick {
+	ac := &ahoCorasick{
+		nodes:    []acNode{{children: map[byte]int{}}},
+		patterns: from,
+		replace:  to,
+	}
+
+	for i, pattern := range from {
+		if pattern == "" {
+			continue
+		}
+
+		cur := 0
+
+		for j := 0; j < len(pattern); j++ {
+			c := pattern[j]
+
+			next, ok := ac.nodes[cur].children[c]
+			if !ok {
+				ac.nodes = append(ac.nodes, acNode{children: map[byte]int{}})
+				next = len(ac.nodes) - 1
+				ac.nodes[cur].children[c] = next
+			}
+
+			cur = next
+		}
+
+		ac.nodes[cur].outputs = append(ac.nodes[cur].outputs, i)
+
+		if len(pattern) > ac.maxLen {
+			ac.maxLen = len(pattern)
+		}
+	}
+
+	ac.buildFailureLinks()
+
+	return ac
+}
+
+// buildFailureLinks runs the standard breadth-first construction of the
+// Aho-Corasick failure function and propagates outputs across fail links so
+// a needle that is a suffix of a longer one is still reported.
+func (ac *ahoCorasick) buildFailureLinks() {
+	queue := make([]int, 0, len(ac.nodes[0].children))
+
+	for _, n := range ac.nodes[0].children {
+		ac.nodes[n].fail = 0
+		queue = append(queue, n)
+	}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		for c, next := range ac.nodes[cur].children {
+			queue = append(queue, next)
+			ac.nodes[next].fail = ac.step(ac.nodes[cur].fail, c)
+			ac.nodes[next].outputs = append(ac.nodes[next].outputs, ac.nodes[ac.nodes[next].fail].outputs...)
+		}
+	}
+}
+
+// step advances the automaton from state on input byte c, following failure
+// links when there is no direct transition. The root implicitly loops back
+// to itself for any byte it has no child for.
+func (ac *ahoCorasick) step(state int, c byte) int {
+	for {
+		if next, ok := ac.nodes[state].children[c]; ok {
+			return next
+		}
+
+		if state == 0 {
+			return 0
+		}
+
+		state = ac.nodes[state].fail
+	}
+}
+
+// firstOutput returns the first (lowest rule-index) needle ending at state,
+// if any.
+func (ac *ahoCorasick) firstOutput(state int) (int, bool) {
+	outputs := ac.nodes[state].outputs
+	if len(outputs) == 0 {
+		return 0, false
+	}
+
+	first := outputs[0]
+	for _, idx := range outputs[1:] {
+		if idx < first {
+			first = idx
+		}
+	}
+
+	return first, true
+}
+
+// automatonCache holds one Aho-Corasick automaton per (Filter, matched rule
+// set) pair. A rule set, not the whole Filter, has to be the cache key:
+// rules are scoped by Host and by URL regex the same way do() scopes them,
+// so a single global automaton built from every rule would fire a rule
+// meant for one vhost against every vhost's responses.
+var automatonCache sync.Map // map[automatonCacheKey]*ahoCorasick
+
+// automatonCacheKey identifies one Filter's automaton for one matched rule
+// set. rules is a stable, human-readable encoding of which Replace indexes
+// matched -- cheap to build and comparable, unlike the []replace slice
+// itself.
+type automatonCacheKey struct {
+	filter *Filter
+	rules  string
+}
+
+// rewriteAutomaton returns the Aho-Corasick automaton covering exactly the
+// Replace rules scoped (by Host and/or urls) to host and requestURL, building
+// and caching it on first use for that rule set.
+func (f *Filter) rewriteAutomaton(host, requestURL string) *ahoCorasick {
+	indexes := matchingReplaceRuleIndexes(f.response.Replace, host, requestURL)
+	key := automatonCacheKey{filter: f, rules: encodeRuleIndexes(indexes)}
+
+	if cached, ok := automatonCache.Load(key); ok {
+		return cached.(*ahoCorasick)
+	}
+
+	from := make([]string, 0, len(indexes))
+	to := make([]string, 0, len(indexes))
+
+	for _, i := range indexes {
+		from = append(from, f.response.Replace[i].from)
+		to = append(to, f.response.Replace[i].to)
+	}
+
+	ac := newAhoCorasick(from, to)
+	automatonCache.Store(key, ac)
+
+	return ac
+}
+
+// encodeRuleIndexes renders indexes (already ascending, from
+// matchingReplaceRuleIndexes) as a comma-separated string suitable for use as
+// a map key.
+func encodeRuleIndexes(indexes []int) string {
+	parts := make([]string, len(indexes))
+	for i, idx := range indexes {
+		parts[i] = strconv.Itoa(idx)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// streamRewrite scans r for every needle in ac and writes the rewritten
+// bytes to w as it goes, reading fixed-size chunks and keeping a rolling
+// tail of ac.maxLen-1 bytes so a needle split across a chunk boundary is
+// still found. It never holds the whole body in memory at once.
+func streamRewrite(w io.Writer, r io.Reader, ac *ahoCorasick) error {
+	if ac == nil || len(ac.patterns) == 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	chunk := make([]byte, defaultChunkSize)
+
+	var pending []byte
+
+	state := 0
+
+	for {
+		n, readErr := r.Read(chunk)
+		if n > 0 {
+			pending = append(pending, chunk[:n]...)
+
+			var err error
+
+			pending, state, err = emitMatches(w, pending, ac, state, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			_, _, err := emitMatches(w, pending, ac, state, true)
+			return err
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// emitMatches advances ac over pending, writing out the bytes that are now
+// known to be either a rewritten match or safely clear of any needle still
+// in progress. It returns the not-yet-written tail and the root state: the
+// next call scans the tail again from its first byte, so the state reached
+// at the end of this call must not be carried over. When flushAll is true
+// (end of stream) the
+// whole remaining tail is written out raw.
+func emitMatches(w io.Writer, pending []byte, ac *ahoCorasick, state int, flushAll bool) ([]byte, int, error) {
+	written := 0
+
+	for i := 0; i < len(pending); i++ {
+		state = ac.step(state, pending[i])
+
+		idx, ok := ac.firstOutput(state)
+		if !ok {
+			continue
+		}
+
+		needle := ac.patterns[idx]
+		start := i + 1 - len(needle)
+
+		if _, err := w.Write(pending[written:start]); err != nil {
+			return nil, 0, err
+		}
+
+		if _, err := io.WriteString(w, ac.replace[idx]); err != nil {
+			return nil, 0, err
+		}
+
+		written = i + 1
+		state = 0
+	}
+
+	if flushAll {
+		if _, err := w.Write(pending[written:]); err != nil {
+			return nil, 0, err
+		}
+
+		return nil, 0, nil
+	}
+
+	safe := len(pending) - (ac.maxLen - 1)
+	if safe > written {
+		if _, err := w.Write(pending[written:safe]); err != nil {
+			return nil, 0, err
+		}
+
+		written = safe
+	}
+
+	tail := make([]byte, len(pending)-written)
+	copy(tail, pending[written:])
+
+	return tail, 0, nil
+}
@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestStreamRewriteBasic(t *testing.T) {
+	ac := newAhoCorasick([]string{"foo", "bar"}, []string{"FOO", "BAR"})
+
+	var out bytes.Buffer
+	if err := streamRewrite(&out, strings.NewReader("a foo b bar c"), ac); err != nil {
+		t.Fatalf("streamRewrite: %v", err)
+	}
+
+	if got, want := out.String(), "a FOO b BAR c"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestStreamRewriteChunkBoundary makes sure a needle split across two reads
+// from the source reader is still found, by feeding the automaton one byte
+// at a time through an io.Reader that trickles its data out.
+func TestStreamRewriteChunkBoundary(t *testing.T) {
+	ac := newAhoCorasick([]string{"needle"}, []string{"FOUND"})
+
+	var out bytes.Buffer
+	if err := streamRewrite(&out, &byteAtATimeReader{data: []byte("xx needle yy")}, ac); err != nil {
+		t.Fatalf("streamRewrite: %v", err)
+	}
+
+	if got, want := out.String(), "xx FOUND yy"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestStreamRewriteNoRules(t *testing.T) {
+	ac := newAhoCorasick(nil, nil)
+
+	var out bytes.Buffer
+	if err := streamRewrite(&out, strings.NewReader("untouched"), ac); err != nil {
+		t.Fatalf("streamRewrite: %v", err)
+	}
+
+	if got, want := out.String(), "untouched"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestRewriteAutomatonHostScoping is the regression test for the headline
+// chunk0-3 bug: a rule scoped to one Host must not rewrite another vhost's
+// response.
+func TestRewriteAutomatonHostScoping(t *testing.T) {
+	f := &Filter{
+		response: rules{
+			Replace: []replace{
+				{Host: "a.example.com", from: "secret", to: "REDACTED"},
+			},
+		},
+	}
+
+	acA := f.rewriteAutomaton("a.example.com", "/")
+
+	var outA bytes.Buffer
+	if err := streamRewrite(&outA, strings.NewReader("a secret value"), acA); err != nil {
+		t.Fatalf("streamRewrite for a.example.com: %v", err)
+	}
+
+	if got, want := outA.String(), "a REDACTED value"; got != want {
+		t.Fatalf("a.example.com: got %q, want %q", got, want)
+	}
+
+	acB := f.rewriteAutomaton("b.example.com", "/")
+
+	var outB bytes.Buffer
+	if err := streamRewrite(&outB, strings.NewReader("a secret value"), acB); err != nil {
+		t.Fatalf("streamRewrite for b.example.com: %v", err)
+	}
+
+	if got, want := outB.String(), "a secret value"; got != want {
+		t.Fatalf("b.example.com should be untouched: got %q, want %q", got, want)
+	}
+}
+
+func TestCapBodyUnderLimit(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader("short"))
+
+	out, rewriting, err := capBody(body, 100)
+	if err != nil {
+		t.Fatalf("capBody: %v", err)
+	}
+
+	if !rewriting {
+		t.Fatal("expected rewriting=true for a body under the limit")
+	}
+
+	got, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatalf("reading capped body: %v", err)
+	}
+
+	if string(got) != "short" {
+		t.Fatalf("got %q, want %q", got, "short")
+	}
+}
+
+// TestCapBodyOverLimitPassesThroughUntouched is the regression test for the
+// chunk0-4 MaxBodyBytes bug: exceeding the cap must hand back the exact
+// original bytes, not a truncated/corrupted stream.
+func TestCapBodyOverLimitPassesThroughUntouched(t *testing.T) {
+	want := "this body is definitely longer than the limit allows"
+	body := ioutil.NopCloser(strings.NewReader(want))
+
+	out, rewriting, err := capBody(body, 10)
+	if err != nil {
+		t.Fatalf("capBody: %v", err)
+	}
+
+	if rewriting {
+		t.Fatal("expected rewriting=false for a body over the limit")
+	}
+
+	got, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatalf("reading passthrough body: %v", err)
+	}
+
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// byteAtATimeReader yields one byte per Read call, to exercise
+// streamRewrite's handling of needles split across reads.
+type byteAtATimeReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteAtATimeReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+
+	p[0] = r.data[r.pos]
+	r.pos++
+
+	return 1, nil
+}
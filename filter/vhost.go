@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"context"
+	"strings"
+)
+
+// VHost binds a Host pattern (e.g. "*.example.com" or "shop.example.com") to
+// the upstream URL that requests for that host should be proxied to. It lets
+// a single villip process front several backends, each with its own rewrite
+// rules selected through the rule's own Host pattern.
+type VHost struct {
+	Host string
+	URL  string
+}
+
+// matchHost reports whether host satisfies pattern. Patterns follow the same
+// convention as HTTP vhost muxers: a bare "*." prefix matches exactly one
+// leftmost label, so "*.example.com" matches "www.example.com" but not
+// "example.com" or "a.www.example.com". An empty pattern matches everything.
+func matchHost(pattern, host string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+
+	host = stripPort(host)
+
+	if !strings.HasPrefix(pattern, "*.") {
+		return strings.EqualFold(pattern, host)
+	}
+
+	suffix := pattern[1:] // ".example.com", dot kept so labels can't bleed together
+
+	if !strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix)) {
+		return false
+	}
+
+	label := host[:len(host)-len(suffix)]
+
+	return label != "" && !strings.Contains(label, ".")
+}
+
+func stripPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i != -1 {
+		return host[:i]
+	}
+
+	return host
+}
+
+// matchingReplaceRules returns the subset of rules scoped to host and
+// requestURL: a rule with a Host pattern only applies to a matching host, and
+// a rule with urls only applies when one of them matches requestURL. Rules
+// with neither restriction match everywhere. do() uses this same scoping for
+// the buffered rewrite path.
+func matchingReplaceRules(rules []replace, host, requestURL string) []replace {
+	indexes := matchingReplaceRuleIndexes(rules, host, requestURL)
+	matched := make([]replace, 0, len(indexes))
+
+	for _, i := range indexes {
+		matched = append(matched, rules[i])
+	}
+
+	return matched
+}
+
+// matchingReplaceRuleIndexes is matchingReplaceRules' matching logic, kept
+// separate so callers that need to identify which rules matched (e.g. to key
+// a cache by rule set) don't have to re-derive indexes from the returned
+// values.
+func matchingReplaceRuleIndexes(rules []replace, host, requestURL string) []int {
+	var indexes []int
+
+	for i, r := range rules {
+		if r.Host != "" && !matchHost(r.Host, host) {
+			continue
+		}
+
+		if len(r.urls) != 0 {
+			found := false
+
+			for _, reg := range r.urls {
+				if reg.MatchString(requestURL) {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				continue
+			}
+		}
+
+		indexes = append(indexes, i)
+	}
+
+	return indexes
+}
+
+// route picks the upstream URL for an incoming Host header against f.vhosts,
+// falling back to f.url so a villip instance with no vhosts configured keeps
+// proxying to its single upstream exactly as before.
+func (f *Filter) route(host string) string {
+	for _, vh := range f.vhosts {
+		if matchHost(vh.Host, host) {
+			return vh.URL
+		}
+	}
+
+	return f.url
+}
+
+type originalHostKey struct{}
+
+// withOriginalHost stashes the Host header the client actually sent, before
+// UpdateRequest rewrites it to the resolved upstream's host, so UpdateResponse
+// can still match response-side rules against it.
+func withOriginalHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, originalHostKey{}, host)
+}
+
+func originalHost(ctx context.Context) string {
+	host, _ := ctx.Value(originalHostKey{}).(string)
+	return host
+}